@@ -1,13 +1,13 @@
 package memory
 
 import (
-	// "errors"
+	"errors"
 	// "fmt"
-	// "os"
 	// "path"
 	// "runtime"
 	// "strings"
 	"math"
+	"os"
 	"runtime/debug"
 	"sync"
 	"time"
@@ -29,15 +29,33 @@ type Cache struct {
 	running  bool
 	capacity int64
 
+	// gen is bumped by Init every time the Cache is (re)initialized for a
+	// torrent, so a goroutine holding a piece index from a previous
+	// generation can tell its Cache has since been repurposed or closed
+	// and bail out instead of indexing into a nil/shorter c.pieces.
+	gen int
+
 	pieceCount    int
 	pieceLength   int64
 	piecePriority []int
 	pieces        []*Piece
 
+	infoHash metainfo.Hash
+	active   map[int]bool
+
 	closing chan struct{}
 
 	buffers   [][]byte
 	positions []*BufferPosition
+
+	spill *spillStore
+	cond  *sync.Cond
+
+	prefetchAhead     int64
+	reservedForReader int64
+	prefetchSem       chan struct{}
+
+	integrityMode IntegrityMode
 }
 
 type BufferPosition struct {
@@ -47,32 +65,113 @@ type BufferPosition struct {
 
 // CacheInfo is a container for basic active Cache into
 type CacheInfo struct {
-	Capacity int64
-	Filled   int64
-	Items    int64
+	Capacity     int64
+	Filled       int64
+	MemoryFilled int64
+	DiskFilled   int64
+	Items        int64
+}
+
+// Option configures optional Cache behaviour at construction time.
+type Option func(*Cache)
+
+// WithSpill enables spilling evicted piece buffers to a bounded on-disk
+// store rooted at baseDir, capped at maxSize bytes (0 means unbounded).
+// The store is shared by every Cache opened against the same baseDir, so
+// maxSize is a combined budget across all of them, not a per-Cache one.
+func WithSpill(baseDir string, maxSize int64) Option {
+	return func(c *Cache) {
+		c.spill = getSpillStore(baseDir, maxSize)
+	}
 }
 
 // NewMemoryStorage initializer function
-func NewMemoryStorage(maxMemorySize int64) *Cache {
+func NewMemoryStorage(maxMemorySize int64, opts ...Option) *Cache {
 	log.Debugf("Memory: %#v", maxMemorySize)
 	c := &Cache{}
 
 	c.SetCapacity(maxMemorySize)
+	for _, opt := range opts {
+		opt(c)
+	}
 
 	return c
 }
 
-// SetCapacity for cache
+// SetCapacity changes the cache's byte budget. It is safe to call while
+// the cache is running: the buffer-slot count is recomputed and
+// c.buffers/c.positions are grown or shrunk under c.mu, evicting pieces
+// via the priority+LRU policy when shrinking, and freeing the reclaimed
+// memory back to the OS.
 func (c *Cache) SetCapacity(capacity int64) {
-	// c.mu.Lock()
-	// defer c.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	log.Debugf("Setting max memory size to %#v bytes", capacity)
+
+	shrinking := c.pieceLength > 0 && capacity < c.capacity
 	c.capacity = capacity
+
+	if c.pieceLength == 0 {
+		// No torrent open yet; Init will size buffers from c.capacity.
+		return
+	}
+
+	size := int64(math.Ceil(float64(capacity)/float64(c.pieceLength))) + 2
+	if size > int64(c.pieceCount) {
+		size = int64(c.pieceCount)
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	for int64(len(c.positions)) > size {
+		last := len(c.positions) - 1
+
+		if c.positions[last].Used {
+			idx := c.positions[last].Index
+
+			// Pick the piece to drop by priority+LRU, not by slot position:
+			// if the policy's victim lives elsewhere in the ring, swap it
+			// into the slot being truncated first.
+			victim := c.evictionCandidate()
+			if victim == -1 {
+				// Nothing safe to evict — every resident piece, including
+				// whichever one holds this slot, is pinned at Now. Stop
+				// shrinking here rather than truncate out from under a
+				// piece that's still in use; the cache simply stays
+				// larger than requested until priorities free up.
+				break
+			}
+
+			if victim != idx {
+				slot := c.pieces[victim].Position
+				c.buffers[slot], c.buffers[last] = c.buffers[last], c.buffers[slot]
+				c.positions[slot], c.positions[last] = c.positions[last], c.positions[slot]
+				c.pieces[idx].Position = slot
+				c.pieces[victim].Position = last
+			}
+
+			c.remove(victim)
+		}
+
+		c.buffers = c.buffers[:last]
+		c.positions = c.positions[:last]
+	}
+
+	for int64(len(c.positions)) < size {
+		c.buffers = append(c.buffers, make([]byte, c.pieceLength))
+		c.positions = append(c.positions, &BufferPosition{})
+	}
+
+	if shrinking {
+		debug.FreeOSMemory()
+	}
 }
 
 // OpenTorrent proxies OpenTorrent from storage to prepare buffers for storing chunks
 func (c *Cache) OpenTorrent(info *metainfo.Info, infoHash metainfo.Hash) (storage.TorrentImpl, error) {
+	c.infoHash = infoHash
 	c.Init(info)
 	go c.Start()
 
@@ -95,9 +194,11 @@ func (c *Cache) Init(info *metainfo.Info) {
 	// c.mu.Lock()
 	// defer c.mu.Unlock()
 
+	c.gen++
 	c.pieceCount = info.NumPieces()
 	c.pieceLength = info.PieceLength
 	c.piecePriority = make([]int, c.pieceCount)
+	c.cond = sync.NewCond(&c.mu)
 
 	// Using max possible buffers + 2
 	size := int64(math.Ceil(float64(c.capacity)/float64(c.pieceLength))) + 2
@@ -131,16 +232,25 @@ func (c *Cache) Info() (ret CacheInfo) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	var items, filled int64
+	var items, memFilled, diskFilled int64
 	for _, v := range c.positions {
 		if v.Used {
 			items++
-			filled += c.pieces[v.Index].Size
+			memFilled += c.pieces[v.Index].Size
+		}
+	}
+
+	for _, p := range c.pieces {
+		if p.Spilled {
+			items++
+			diskFilled += p.Length
 		}
 	}
 
 	ret.Capacity = c.capacity
-	ret.Filled = filled
+	ret.MemoryFilled = memFilled
+	ret.DiskFilled = diskFilled
+	ret.Filled = memFilled + diskFilled
 	ret.Items = items
 	return
 }
@@ -160,7 +270,8 @@ func (c *Cache) RemovePiece(idx int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if idx < len(c.pieces) && c.pieces[idx].Position != -1 {
+	if idx < len(c.pieces) && c.pieces[idx].Position != -1 && c.piecePriority[idx] != PiecePriorityNow {
+		gen := c.gen
 		go func() {
 			delay := time.NewTicker(150 * time.Millisecond)
 			defer delay.Stop()
@@ -168,7 +279,14 @@ func (c *Cache) RemovePiece(idx int) {
 			for {
 				select {
 				case <-delay.C:
-					c.remove(idx)
+					c.mu.Lock()
+					// The Cache may have been Stop()ped or re-Init()ed for
+					// a different torrent while we were waiting; idx no
+					// longer refers to the piece we were asked to remove.
+					if c.running && c.gen == gen && idx < len(c.pieces) {
+						c.remove(idx)
+					}
+					c.mu.Unlock()
 					return
 				}
 			}
@@ -180,6 +298,8 @@ func (c *Cache) SyncPieces(active map[int]bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.active = active
+
 	for _, v := range c.positions {
 		if _, ok := active[v.Index]; v.Used && !ok {
 			c.remove(v.Index)
@@ -204,6 +324,9 @@ func (c *Cache) Start() {
 			info := c.Info()
 			log.Debugf("Cap: %d | Size: %d | Items: %d \n", info.Capacity, info.Filled, info.Items)
 
+			c.purgeSpill()
+			c.scrubPieces()
+
 			// str := ""
 			// for i := 0; i < 30; i++ {
 			// 	str += fmt.Sprintf(" %d:%v", i, c.pieces[i].Position)
@@ -230,28 +353,215 @@ func (c *Cache) Stop() {
 
 	c.closing <- struct{}{}
 
+	c.gen++
 	c.buffers = nil
 	c.pieces = nil
 	c.positions = nil
 
+	// The spill store is shared across every Cache pointed at the same
+	// baseDir, so nothing else will reclaim this torrent's spilled
+	// entries once this Cache is gone; purge them now or they sit on
+	// disk forever, eating into the shared maxSize budget.
+	c.purgeAllSpill()
+
 	debug.FreeOSMemory()
 }
 
+// remove frees pi's buffer slot under c.mu, then — if the piece is
+// eligible to spill — copies its bytes out and writes them to disk from a
+// background goroutine, so a slow spill write never stalls other piece
+// access on this torrent while the lock is held. Called with c.mu held.
 func (c *Cache) remove(pi int) {
-	// Don't allow to delete first piece, it's used everywhere
-	if pi == 0 {
+	// log.Debugf("Removing element: %#v", pi)
+
+	p := c.pieces[pi]
+	if p.Position == -1 {
 		return
 	}
 
-	// log.Debugf("Removing element: %#v", pi)
+	// Never reclaim a piece the reader is on right now; everything else is
+	// fair game under priority+LRU pressure.
+	if c.piecePriority[pi] == PiecePriorityNow {
+		return
+	}
+
+	spillEligible := c.spill != nil && p.Completed
+	var spillData []byte
+	if spillEligible {
+		spillData = append([]byte(nil), c.buffers[p.Position][:p.Length]...)
+	} else {
+		p.Completed = false
+		p.Size = 0
+	}
+
+	c.positions[p.Position].Used = false
+	p.Chunks.Clear()
+	p.Position = -1
+	p.Active = false
+
+	if !spillEligible {
+		return
+	}
+
+	spill := c.spill
+	infoHash := c.infoHash
+	p.Spilling = true
+	go func() {
+		path, err := spill.write(infoHash, pi, spillData)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
 
-	if c.pieces[pi].Position != -1 {
-		c.positions[c.pieces[pi].Position].Used = false
+		p.Spilling = false
+		defer c.cond.Broadcast()
+
+		// The piece may have been reassigned a fresh buffer slot (e.g. a
+		// new write landed) while this write was in flight; don't clobber
+		// its now-current state with a stale spill result.
+		if p.Position != -1 {
+			return
+		}
+
+		if err != nil {
+			p.Completed = false
+			p.Size = 0
+			return
+		}
+
+		p.SpillPath = path
+		p.Spilled = true
+	}()
+}
+
+// assign gives p a free buffer slot, evicting the lowest-priority,
+// least-recently-used occupant if none is free.
+func (c *Cache) assign(p *Piece) error {
+	for i, pos := range c.positions {
+		if !pos.Used {
+			pos.Used = true
+			pos.Index = p.Index
+			p.Position = i
+			return nil
+		}
+	}
+
+	victim := c.evictionCandidate()
+	if victim == -1 {
+		return errors.New("memory: no evictable buffer slot available")
+	}
+
+	slot := c.pieces[victim].Position
+	c.remove(victim)
+
+	c.positions[slot].Used = true
+	c.positions[slot].Index = p.Index
+	p.Position = slot
+
+	return nil
+}
+
+// evictionCandidate returns the resident piece that should be reclaimed
+// first: the lowest piecePriority, breaking ties by least recently
+// accessed. Pieces at PiecePriorityNow are never returned, so a full
+// cache of Now pieces yields -1: assign then fails with an error and
+// SetCapacity stops shrinking.
+func (c *Cache) evictionCandidate() int {
+	best := -1
+
+	for _, pos := range c.positions {
+		if !pos.Used {
+			continue
+		}
+
+		idx := pos.Index
+		if c.piecePriority[idx] == PiecePriorityNow {
+			continue
+		}
+
+		if best == -1 ||
+			c.piecePriority[idx] < c.piecePriority[best] ||
+			(c.piecePriority[idx] == c.piecePriority[best] && c.pieces[idx].LastAccess.Before(c.pieces[best].LastAccess)) {
+			best = idx
+		}
+	}
+
+	return best
+}
+
+// rehydrate reloads a spilled piece's bytes into a freshly assigned
+// buffer slot, so readers never see the eviction that happened earlier.
+// Called with c.mu held; the lock is dropped around the actual disk read
+// so a slow spill disk doesn't stall every other piece access on this
+// torrent, and re-validated against the piece's state once retaken.
+func (c *Cache) rehydrate(p *Piece) error {
+	if c.spill == nil || !p.Spilled {
+		return os.ErrNotExist
+	}
+
+	spill := c.spill
+	path := p.SpillPath
+
+	c.mu.Unlock()
+	data, err := spill.read(path)
+	c.mu.Lock()
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !p.Spilled && p.Position != -1:
+		// Another goroutine already rehydrated it while we were reading
+		// from disk; nothing left for us to do.
+		return nil
+	case !p.Spilled || p.SpillPath != path:
+		// The piece moved on in some other way (re-evicted under a new
+		// path, etc.) while the lock was dropped; let the caller retry.
+		return errors.New("memory: piece changed while rehydrating, retry")
+	}
+
+	if err := c.assign(p); err != nil {
+		return err
+	}
+
+	copy(c.buffers[p.Position], data)
+	c.spill.remove(path)
+
+	p.SpillPath = ""
+	p.Spilled = false
+
+	return nil
+}
+
+// purgeSpill drops this torrent's spilled entries whose piece SyncPieces
+// since marked inactive. Entries of other info hashes are left alone, and
+// nothing is dropped before the first SyncPieces call.
+func (c *Cache) purgeSpill() {
+	c.mu.Lock()
+	spill := c.spill
+	infoHash := c.infoHash
+	active := c.active
+	c.mu.Unlock()
+
+	if spill == nil {
+		return
+	}
+
+	spill.purge(infoHash, active)
+}
+
+// purgeAllSpill drops every spilled entry belonging to this Cache's
+// torrent, regardless of active state. Called from Stop so a closed
+// torrent doesn't leave orphaned entries behind in the shared store.
+func (c *Cache) purgeAllSpill() {
+	c.mu.Lock()
+	spill := c.spill
+	infoHash := c.infoHash
+	c.mu.Unlock()
+
+	if spill == nil {
+		return
 	}
 
-	c.pieces[pi].Chunks.Clear()
-	c.pieces[pi].Position = -1
-	c.pieces[pi].Completed = false
-	c.pieces[pi].Active = false
-	c.pieces[pi].Size = 0
+	spill.purge(infoHash, map[int]bool{})
 }
\ No newline at end of file
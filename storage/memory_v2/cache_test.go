@@ -0,0 +1,103 @@
+package memory
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSetCapacityShrinkPreservesPinnedPiece(t *testing.T) {
+	c := newTestCache(t, 4, 1024, 4*1024)
+
+	data := make([]byte, 1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := c.pieces[i].WriteAt(data, 0); err != nil {
+			t.Fatalf("WriteAt piece %d: %v", i, err)
+		}
+	}
+
+	// Pin whichever piece currently occupies the last buffer slot, so the
+	// shrink below is forced to deal with a pinned piece sitting exactly
+	// where it wants to truncate.
+	lastSlot := len(c.positions) - 1
+	pinned := c.positions[lastSlot].Index
+	c.SetPiecePriority(pinned, PiecePriorityNow)
+
+	c.SetCapacity(1024) // shrinks the ring down to ceil(1024/1024)+2 = 3 buffer slots
+
+	if c.pieces[pinned].Position == -1 {
+		t.Fatalf("pinned piece %d was evicted by shrink", pinned)
+	}
+
+	// The slot bookkeeping must agree with the piece: the slot the pinned
+	// piece now claims has to actually be marked Used and pointing back at
+	// it, or a later assign() will think that slot is free and hand it to
+	// a new piece out from under the reader.
+	slot := c.pieces[pinned].Position
+	if !c.positions[slot].Used || c.positions[slot].Index != pinned {
+		t.Fatalf("slot %d bookkeeping inconsistent after shrink: Used=%v Index=%d, want Used=true Index=%d",
+			slot, c.positions[slot].Used, c.positions[slot].Index, pinned)
+	}
+
+	out := make([]byte, 1024)
+	if _, err := c.pieces[pinned].ReadAt(out, 0); err != nil {
+		t.Fatalf("ReadAt pinned piece after shrink: %v", err)
+	}
+
+	if !bytes.Equal(data, out) {
+		t.Fatalf("pinned piece bytes corrupted by shrink")
+	}
+
+	// Simulate a subsequent write landing in a fresh slot: if the stale
+	// bookkeeping let it reuse the pinned piece's slot, this would
+	// overwrite the pinned piece's live bytes.
+	other := (pinned + 1) % len(c.pieces)
+	if other == pinned {
+		return
+	}
+	if _, err := c.pieces[other].WriteAt(bytes.Repeat([]byte{0xFF}, 1024), 0); err != nil {
+		t.Fatalf("WriteAt piece %d: %v", other, err)
+	}
+
+	if _, err := c.pieces[pinned].ReadAt(out, 0); err != nil {
+		t.Fatalf("ReadAt pinned piece after further writes: %v", err)
+	}
+	if !bytes.Equal(data, out) {
+		t.Fatalf("pinned piece bytes clobbered by a later write reusing its slot")
+	}
+}
+
+// TestSetCapacityShrinkWithNoEvictableSlotStopsEarly covers the case where
+// every resident piece is pinned at PiecePriorityNow, so there is no
+// victim to swap in before truncating: SetCapacity must leave the ring
+// large enough to hold them rather than truncate a slot still in use.
+func TestSetCapacityShrinkWithNoEvictableSlotStopsEarly(t *testing.T) {
+	c := newTestCache(t, 3, 1024, 3*1024)
+
+	data := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		if _, err := c.pieces[i].WriteAt(data, 0); err != nil {
+			t.Fatalf("WriteAt piece %d: %v", i, err)
+		}
+		c.SetPiecePriority(i, PiecePriorityNow)
+	}
+
+	c.SetCapacity(0)
+
+	if len(c.positions) < 3 {
+		t.Fatalf("expected SetCapacity to keep all 3 pinned slots, got %d", len(c.positions))
+	}
+
+	out := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		if c.pieces[i].Position == -1 {
+			t.Fatalf("pinned piece %d was evicted despite having nowhere safe to go", i)
+		}
+		if _, err := c.pieces[i].ReadAt(out, 0); err != nil {
+			t.Fatalf("ReadAt pinned piece %d after shrink: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package memory
+
+import "github.com/dustin/go-humanize"
+
+// NewMemoryStorageFromString is NewMemoryStorage but accepts a
+// human-readable capacity such as "64MB" or "1.5GiB", matching the
+// ergonomics expected from config values like blobCacheSize=64MB.
+func NewMemoryStorageFromString(capacity string, opts ...Option) (*Cache, error) {
+	bytes, err := humanize.ParseBytes(capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMemoryStorage(int64(bytes), opts...), nil
+}
+
+// SetCapacityString is SetCapacity but accepts a human-readable capacity
+// such as "64MB" or "1.5GiB".
+func (c *Cache) SetCapacityString(capacity string) error {
+	bytes, err := humanize.ParseBytes(capacity)
+	if err != nil {
+		return err
+	}
+
+	c.SetCapacity(int64(bytes))
+	return nil
+}
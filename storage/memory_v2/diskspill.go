@@ -0,0 +1,138 @@
+package memory
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// spillStore is a bounded on-disk store for piece buffers evicted from
+// memory under capacity pressure. Entries are keyed by torrent info hash
+// and piece index so stale entries from a previous torrent can be told
+// apart from the one currently playing.
+type spillStore struct {
+	baseDir string
+	maxSize int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+func newSpillStore(baseDir string, maxSize int64) *spillStore {
+	os.MkdirAll(baseDir, 0755)
+
+	return &spillStore{
+		baseDir: baseDir,
+		maxSize: maxSize,
+	}
+}
+
+var (
+	spillStoresMu sync.Mutex
+	spillStores   = map[string]*spillStore{}
+)
+
+// getSpillStore returns the spillStore shared by every Cache pointed at
+// baseDir, creating it on first use. This is what makes maxSize a real
+// combined budget across concurrent torrents rather than a separate
+// allowance per Cache; maxSize from whichever Cache opens baseDir first
+// wins, later callers just share that instance.
+func getSpillStore(baseDir string, maxSize int64) *spillStore {
+	spillStoresMu.Lock()
+	defer spillStoresMu.Unlock()
+
+	if s, ok := spillStores[baseDir]; ok {
+		return s
+	}
+
+	s := newSpillStore(baseDir, maxSize)
+	spillStores[baseDir] = s
+	return s
+}
+
+func (s *spillStore) path(infoHash metainfo.Hash, index int) string {
+	return filepath.Join(s.baseDir, fmt.Sprintf("%s.%d.bin", infoHash.HexString(), index))
+}
+
+// write spills data to disk, refusing to grow past maxSize. Callers are
+// expected to remove() the returned path once the data is rehydrated or
+// no longer needed. s.mu is only held long enough to reserve/release the
+// size budget; the store is shared across every Cache at this baseDir, so
+// the blocking os.WriteFile itself must happen outside the lock or one
+// torrent's slow disk stalls every other torrent's spill traffic.
+func (s *spillStore) write(infoHash metainfo.Hash, index int, data []byte) (string, error) {
+	size := int64(len(data))
+
+	s.mu.Lock()
+	if s.maxSize > 0 && s.used+size > s.maxSize {
+		s.mu.Unlock()
+		return "", fmt.Errorf("memory: spill store is full")
+	}
+	s.used += size
+	s.mu.Unlock()
+
+	path := s.path(infoHash, index)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		s.mu.Lock()
+		s.used -= size
+		s.mu.Unlock()
+		return "", err
+	}
+
+	return path, nil
+}
+
+func (s *spillStore) read(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+// remove deletes path and releases its size from the budget. The
+// os.Stat/os.Remove happen outside s.mu for the same reason as write: this
+// store is shared across every Cache at this baseDir, and disk I/O must
+// not serialize behind one global lock.
+func (s *spillStore) remove(path string) error {
+	info, statErr := os.Stat(path)
+
+	err := os.Remove(path)
+
+	if statErr == nil {
+		s.mu.Lock()
+		s.used -= info.Size()
+		s.mu.Unlock()
+	}
+
+	return err
+}
+
+// purge drops entries for infoHash whose piece index is no longer in
+// keep. This is what lets the store recover space after SyncPieces
+// shrinks the active set. baseDir is shared by every Cache the app opens,
+// so purge intentionally never touches entries for other info hashes —
+// another torrent's cache may still be legitimately using them.
+func (s *spillStore) purge(infoHash metainfo.Hash, keep map[int]bool) {
+	if keep == nil {
+		return
+	}
+
+	entries, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return
+	}
+
+	prefix := infoHash.HexString() + "."
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		var idx int
+		if _, err := fmt.Sscanf(name, prefix+"%d.bin", &idx); err == nil && !keep[idx] {
+			s.remove(filepath.Join(s.baseDir, name))
+		}
+	}
+}
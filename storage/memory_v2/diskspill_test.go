@@ -0,0 +1,142 @@
+package memory
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// newTestCache builds a Cache over a synthetic torrent with pieceCount
+// pieces of pieceLength bytes each, sized to capacity bytes of buffers.
+func newTestCache(t *testing.T, pieceCount int, pieceLength, capacity int64, opts ...Option) *Cache {
+	t.Helper()
+
+	c := NewMemoryStorage(capacity, opts...)
+	info := &metainfo.Info{
+		PieceLength: pieceLength,
+		Pieces:      make([]byte, pieceCount*20),
+		Length:      pieceLength * int64(pieceCount),
+	}
+	c.Init(info)
+
+	return c
+}
+
+// waitForSpilled polls p.Spilled under c.mu, since remove writes the
+// spilled piece to disk from a background goroutine rather than before
+// releasing the lock.
+func waitForSpilled(t *testing.T, c *Cache, p *Piece) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		spilled := p.Spilled
+		c.mu.Unlock()
+
+		if spilled {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for piece to spill to disk")
+}
+
+func TestSpillRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestCache(t, 4, 1024, 4*1024, WithSpill(dir, 0))
+
+	data := bytes.Repeat([]byte{0xAB}, 1024)
+	p := c.pieces[1]
+	if _, err := p.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	p.MarkComplete()
+
+	c.mu.Lock()
+	c.remove(1)
+	c.mu.Unlock()
+
+	// The actual spill write happens on a background goroutine now, so
+	// give it a moment to land before asserting on it.
+	waitForSpilled(t, c, p)
+
+	if p.Position != -1 {
+		t.Fatalf("expected spilled piece to have no buffer slot")
+	}
+
+	out := make([]byte, 1024)
+	if _, err := p.ReadAt(out, 0); err != nil {
+		t.Fatalf("ReadAt after spill: %v", err)
+	}
+
+	if !bytes.Equal(data, out) {
+		t.Fatalf("rehydrated bytes do not match original")
+	}
+	if p.Spilled {
+		t.Fatalf("piece should no longer be marked spilled once rehydrated")
+	}
+}
+
+// TestPurgeOnlyTouchesOwnInfoHash covers the cross-torrent deletion bug
+// fixed alongside this test: a Cache's purge must only ever clean up the
+// entries for its own infoHash, even when another torrent's entries sit
+// in the same shared baseDir.
+func TestPurgeOnlyTouchesOwnInfoHash(t *testing.T) {
+	dir := t.TempDir()
+	store := newSpillStore(dir, 0)
+
+	var hashA, hashB metainfo.Hash
+	hashA[0] = 0xAA
+	hashB[0] = 0xBB
+
+	pathA, err := store.write(hashA, 0, []byte("torrent A piece 0"))
+	if err != nil {
+		t.Fatalf("write A: %v", err)
+	}
+	pathB, err := store.write(hashB, 0, []byte("torrent B piece 0"))
+	if err != nil {
+		t.Fatalf("write B: %v", err)
+	}
+
+	// Torrent A's active set no longer includes piece 0, so a purge scoped
+	// to hashA should remove pathA but must leave hashB's entry untouched.
+	store.purge(hashA, map[int]bool{})
+
+	if _, err := os.Stat(pathA); !os.IsNotExist(err) {
+		t.Fatalf("expected torrent A's stale entry to be purged, stat err: %v", err)
+	}
+	if _, err := os.Stat(pathB); err != nil {
+		t.Fatalf("expected torrent B's entry to survive a purge scoped to torrent A: %v", err)
+	}
+}
+
+// TestSpillBudgetSharedAcrossCaches covers the fix making maxSize a real
+// combined budget: two Caches pointed at the same baseDir must share one
+// spillStore, so one torrent filling the budget is visible to another
+// rather than each tracking its own separate allowance.
+func TestSpillBudgetSharedAcrossCaches(t *testing.T) {
+	dir := t.TempDir()
+
+	sA := getSpillStore(dir, 1024)
+	sB := getSpillStore(dir, 1024)
+
+	if sA != sB {
+		t.Fatalf("expected caches pointed at the same baseDir to share one spillStore")
+	}
+
+	var hash metainfo.Hash
+	if _, err := sA.write(hash, 0, bytes.Repeat([]byte{0xCD}, 1024)); err != nil {
+		t.Fatalf("write via A: %v", err)
+	}
+
+	// The budget is shared, so B must see it as exhausted even though it
+	// never wrote anything itself.
+	if _, err := sB.write(hash, 1, []byte{0x01}); err == nil {
+		t.Fatalf("expected write via B to be refused once the shared budget was exhausted by A")
+	}
+}
@@ -0,0 +1,68 @@
+package memory
+
+import "github.com/cespare/xxhash/v2"
+
+// IntegrityMode controls when piece buffers get an xxhash64 checksum
+// computed and re-verified, guarding against corruption from
+// BufferPosition slot-reuse races that would otherwise go unnoticed
+// until the torrent client re-hashes the piece.
+type IntegrityMode int
+
+const (
+	// IntegrityOff disables checksumming entirely.
+	IntegrityOff IntegrityMode = iota
+	// IntegrityOnWrite checksums a piece once, when it completes.
+	IntegrityOnWrite
+	// IntegrityOnRead additionally re-verifies the checksum on every ReadAt.
+	IntegrityOnRead
+	// IntegrityScrub checksums on completion and re-verifies periodically
+	// from a background goroutine instead of on every read.
+	IntegrityScrub
+)
+
+// WithIntegrityMode sets the Cache's initial IntegrityMode.
+func WithIntegrityMode(mode IntegrityMode) Option {
+	return func(c *Cache) {
+		c.integrityMode = mode
+	}
+}
+
+// SetIntegrityMode changes the integrity mode of a running Cache.
+func (c *Cache) SetIntegrityMode(mode IntegrityMode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.integrityMode = mode
+}
+
+func (c *Cache) checksum(p *Piece) uint64 {
+	return xxhash.Sum64(c.buffers[p.Position][:p.Length])
+}
+
+// scrubPieces re-verifies every resident, completed piece's checksum and
+// evicts (forcing a re-download of) any that no longer match. It is a
+// no-op unless the Cache is in IntegrityScrub mode.
+func (c *Cache) scrubPieces() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.integrityMode != IntegrityScrub {
+		return
+	}
+
+	for _, pos := range c.positions {
+		if !pos.Used {
+			continue
+		}
+
+		p := c.pieces[pos.Index]
+		if !p.Completed {
+			continue
+		}
+
+		if c.checksum(p) != p.Checksum {
+			log.Warningf("Memory: checksum mismatch on piece %d, evicting for re-download", p.Index)
+			c.remove(p.Index)
+		}
+	}
+}
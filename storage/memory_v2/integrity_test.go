@@ -0,0 +1,35 @@
+package memory
+
+import "testing"
+
+// TestScrubEvictsCorruptedPiece covers IntegrityScrub: a resident,
+// completed piece whose buffer no longer matches its recorded checksum
+// must be evicted so the torrent engine re-downloads it, rather than
+// being served silently corrupted.
+func TestScrubEvictsCorruptedPiece(t *testing.T) {
+	c := newTestCache(t, 2, 1024, 2*1024, WithIntegrityMode(IntegrityScrub))
+
+	data := make([]byte, 1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	p := c.pieces[0]
+	if _, err := p.WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	p.MarkComplete()
+
+	// Corrupt the resident buffer directly, bypassing WriteAt, to simulate
+	// the slot-reuse race the checksum is meant to catch.
+	c.buffers[p.Position][0] ^= 0xFF
+
+	c.scrubPieces()
+
+	if p.Position != -1 {
+		t.Fatalf("expected corrupted piece to be evicted by scrub")
+	}
+	if p.Completed {
+		t.Fatalf("expected corrupted piece to be marked not complete after scrub eviction")
+	}
+}
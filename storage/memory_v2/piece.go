@@ -0,0 +1,157 @@
+package memory
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/anacrolix/torrent/storage"
+	"github.com/RoaringBitmap/roaring"
+)
+
+// chunkSize mirrors the default BitTorrent request size and is only used
+// to size the Chunks bitmap; it has no bearing on actual network requests.
+const chunkSize = 16 * 1024
+
+// Piece implements storage.PieceImpl backed by a slot in the Cache's ring
+// of memory buffers. Once evicted, a piece may be spilled to disk instead
+// of being dropped outright; ReadAt rehydrates it transparently so the
+// torrent engine never notices the difference.
+type Piece struct {
+	c *Cache
+
+	Index  int
+	Length int64
+	Size   int64
+	Hash   string
+
+	// Position indexes into Cache.buffers/positions, or -1 if the piece
+	// isn't currently resident in memory.
+	Position int
+	Chunks   *roaring.Bitmap
+
+	Active    bool
+	Completed bool
+
+	// LastAccess is updated on every ReadAt/WriteAt and drives the
+	// least-recently-used half of the eviction policy.
+	LastAccess time.Time
+
+	// SpillPath is where this piece's bytes were written after being
+	// evicted from memory, set only while Spilled is true.
+	SpillPath string
+	Spilled   bool
+
+	// Spilling is true from the moment remove() hands this piece's bytes
+	// to the background spill-write goroutine until that goroutine
+	// finishes, so ReadAt can wait out the gap instead of failing a read
+	// for data that is momentarily neither resident nor spilled.
+	Spilling bool
+
+	// Checksum is the xxhash64 of the piece's buffer, computed at
+	// MarkComplete when the Cache's IntegrityMode is not IntegrityOff.
+	Checksum uint64
+}
+
+// ReadAt satisfies io.ReaderAt, rehydrating the piece from disk first if
+// it was spilled rather than forcing a re-download.
+func (p *Piece) ReadAt(b []byte, off int64) (n int, err error) {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+
+	for p.Position == -1 && p.Spilling {
+		p.c.cond.Wait()
+	}
+
+	if p.Position == -1 {
+		if !p.Spilled {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		if err = p.c.rehydrate(p); err != nil {
+			return 0, err
+		}
+	}
+
+	if p.Completed && p.c.integrityMode == IntegrityOnRead {
+		if p.c.checksum(p) != p.Checksum {
+			p.c.remove(p.Index)
+			return 0, errors.New("memory: checksum mismatch, piece evicted for re-download")
+		}
+	}
+
+	n = copy(b, p.c.buffers[p.Position][off:])
+	p.LastAccess = time.Now()
+	return n, nil
+}
+
+// WriteAt satisfies io.WriterAt, assigning this piece a buffer slot on
+// first write.
+func (p *Piece) WriteAt(b []byte, off int64) (n int, err error) {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+
+	if p.Position == -1 {
+		if err = p.c.assign(p); err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p.c.buffers[p.Position][off:], b)
+	p.Chunks.Add(uint32(off / chunkSize))
+	p.LastAccess = time.Now()
+
+	if filled := off + int64(n); filled > p.Size {
+		p.Size = filled
+	}
+
+	return n, nil
+}
+
+// MarkComplete is called by the torrent engine once the piece passed its
+// hash check.
+func (p *Piece) MarkComplete() error {
+	p.c.mu.Lock()
+
+	// A piece below PiecePriorityNow can be evicted mid-download, before
+	// it was ever marked complete, so it was never spill-eligible either;
+	// with neither a resident buffer nor a spilled copy there's nothing
+	// to back a "complete" piece, so refuse rather than leaving behind a
+	// Completed piece every ReadAt will fail on.
+	if p.Position == -1 && !p.Spilled {
+		p.c.mu.Unlock()
+		return errors.New("memory: piece was evicted before completion, re-download required")
+	}
+
+	p.Completed = true
+	// The piece may have been spilled between its last WriteAt and this
+	// call, in which case there's no resident buffer left to checksum;
+	// the next rehydrate/scrub will catch corruption once it's resident
+	// again.
+	if p.c.integrityMode != IntegrityOff && p.Position != -1 {
+		p.Checksum = p.c.checksum(p)
+	}
+	p.c.mu.Unlock()
+
+	p.c.cond.Broadcast()
+	return nil
+}
+
+// MarkNotComplete is called by the torrent engine when the piece fails
+// its hash check and needs to be re-downloaded.
+func (p *Piece) MarkNotComplete() error {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+
+	p.Completed = false
+	return nil
+}
+
+// Completion reports whether the piece's bytes are valid, regardless of
+// whether they currently live in memory or on a spill disk.
+func (p *Piece) Completion() storage.Completion {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+
+	return storage.Completion{Complete: p.Completed, Ok: true}
+}
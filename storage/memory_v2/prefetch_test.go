@@ -0,0 +1,29 @@
+package memory
+
+import "testing"
+
+// TestPrefetchBackpressureDropsFurthestAhead covers Prefetch's budget cap:
+// with workers=0 so no goroutines are spawned, only the pieces that fit in
+// capacity-reservedForReader get their priority raised, and the furthest
+// ones are left untouched rather than all being queued.
+func TestPrefetchBackpressureDropsFurthestAhead(t *testing.T) {
+	c := newTestCache(t, 10, 1024, 5*1024, WithPrefetch(9*1024, 0, 0))
+
+	c.Prefetch(0, 1024)
+
+	// budget = capacity(5*1024) - reservedForReader(0) = 5*1024, so
+	// maxPieces = 5: pieces 0-4 should be raised, 5-9 left alone.
+	if got := c.piecePriority[0]; got != PiecePriorityNext {
+		t.Fatalf("piece 0: want PiecePriorityNext, got %d", got)
+	}
+	for i := 1; i < 5; i++ {
+		if got := c.piecePriority[i]; got != PiecePriorityReadahead {
+			t.Fatalf("piece %d: want PiecePriorityReadahead, got %d", i, got)
+		}
+	}
+	for i := 5; i < 10; i++ {
+		if got := c.piecePriority[i]; got != PiecePriorityNone {
+			t.Fatalf("piece %d: expected to be left at PiecePriorityNone under budget pressure, got %d", i, got)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package memory
+
+import "math"
+
+// Piece priority levels, analogous to the PiecePriority levels exposed by
+// anacrolix/torrent. Higher values are more urgent and are preferred both
+// for download ordering and for surviving eviction.
+const (
+	PiecePriorityNone = iota
+	PiecePriorityNormal
+	PiecePriorityReadahead
+	PiecePriorityNext
+	PiecePriorityNow
+)
+
+// SetPiecePriority lets the file-serving layer hint which pieces must not
+// be evicted. Pieces at PiecePriorityNow are never reclaimed by remove().
+func (c *Cache) SetPiecePriority(idx int, prio int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if idx < 0 || idx >= len(c.piecePriority) {
+		return
+	}
+
+	c.piecePriority[idx] = prio
+}
+
+// SetReaderPosition re-derives piece priorities from where a reader
+// currently is in the file and how far ahead it reads: the piece holding
+// fileOffset becomes PiecePriorityNow, the one right after it
+// PiecePriorityNext, and the following readaheadBytes worth of pieces
+// PiecePriorityReadahead. Everything else drops back to
+// PiecePriorityNormal, unless it was already PiecePriorityNone.
+func (c *Cache) SetReaderPosition(fileOffset, readaheadBytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pieceLength == 0 {
+		return
+	}
+
+	current := int(fileOffset / c.pieceLength)
+	ahead := int(math.Ceil(float64(readaheadBytes) / float64(c.pieceLength)))
+
+	for i := range c.piecePriority {
+		switch {
+		case i == current:
+			c.piecePriority[i] = PiecePriorityNow
+		case i == current+1:
+			c.piecePriority[i] = PiecePriorityNext
+		case i > current+1 && i <= current+1+ahead:
+			c.piecePriority[i] = PiecePriorityReadahead
+		case c.piecePriority[i] != PiecePriorityNone:
+			c.piecePriority[i] = PiecePriorityNormal
+		}
+	}
+}
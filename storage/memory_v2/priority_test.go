@@ -0,0 +1,39 @@
+package memory
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvictionPrefersLowestPriorityThenLRU(t *testing.T) {
+	// 4 pieces, but a capacity that only buys 3 buffer slots, so the 4th
+	// write forces an eviction among the first 3.
+	c := newTestCache(t, 4, 1024, 1024)
+
+	data := make([]byte, 1024)
+	for i := 0; i < 3; i++ {
+		if _, err := c.pieces[i].WriteAt(data, 0); err != nil {
+			t.Fatalf("WriteAt piece %d: %v", i, err)
+		}
+	}
+
+	// Piece 2 must survive because it's pinned at PiecePriorityNow, which
+	// eviction never reclaims. Piece 0 is the least recently
+	// accessed of the remaining, evictable pieces.
+	c.SetPiecePriority(2, PiecePriorityNow)
+	c.pieces[0].LastAccess = c.pieces[0].LastAccess.Add(-time.Hour)
+
+	if _, err := c.pieces[3].WriteAt(data, 0); err != nil {
+		t.Fatalf("WriteAt piece 3: %v", err)
+	}
+
+	if c.pieces[0].Position != -1 {
+		t.Fatalf("expected least-recently-used, lowest priority piece 0 to be evicted")
+	}
+	if c.pieces[2].Position == -1 {
+		t.Fatalf("expected PiecePriorityNow piece 2 to survive eviction")
+	}
+	if c.pieces[3].Position == -1 {
+		t.Fatalf("expected newly written piece 3 to get a buffer slot")
+	}
+}